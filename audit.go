@@ -0,0 +1,71 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is a single structured record of a port change (or attempt)
+// made by this tool, written as one JSON object per line to the audit log.
+type auditEvent struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Site          string    `json:"site"`
+	Switch        string    `json:"switch"` // DeviceID; the switch name for "fail", where the switch lookup failed
+	Port          int       `json:"port"`
+	Action        string    `json:"action"` // "block", "unblock", "force-unblock" or "fail"
+	PrevProfileID string    `json:"prevProfileId,omitempty"`
+	NewProfileID  string    `json:"newProfileId,omitempty"`
+	EventID       string    `json:"eventId,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// auditLogger appends auditEvents as JSON lines to a file. Writes are
+// append-only so copytruncate-style rotation is safe. The file is opened once
+// and never reopened, so after a rename-style rotation a long-running process
+// keeps writing to the renamed file.
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newAuditLogger opens (creating if necessary) the audit log at path for
+// appending.
+func newAuditLogger(path string) (*auditLogger, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: f}, nil
+}
+
+// log appends a single auditEvent to the log file.
+func (a *auditLogger) log(event auditEvent) error {
+	if a == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(data)
+	return err
+}
+
+// close closes the underlying audit log file.
+func (a *auditLogger) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
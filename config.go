@@ -0,0 +1,284 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	checker "github.com/BFLB/monitoringplugin"
+	r "github.com/BFLB/monitoringplugin/range"
+	"github.com/BFLB/monitoringplugin/status"
+	activeWriter "github.com/BFLB/monitoringplugin/writers/activeWriter"
+	"github.com/BFLB/unifi"
+	"gopkg.in/yaml.v3"
+)
+
+// switchPolicy configures how one switch (or, with name "*", every switch not
+// matched more specifically) on a site is protected. Scoping is per switch
+// only: PortNameCurr/PortNameBlock rename whichever port on the matched
+// switch triggered the event, they are not themselves a matching key, so a
+// policy cannot be scoped to one port name on a switch shared with others.
+type switchPolicy struct {
+	Name          string `yaml:"name"`
+	ProfileCurr   string `yaml:"profileCurr"`
+	ProfileBlock  string `yaml:"profileBlock"`
+	PortNameCurr  string `yaml:"portNameCurr"`
+	PortNameBlock string `yaml:"portNameBlock"`
+	NotifyWebhook string `yaml:"notifyWebhook"`
+	NotifySlack   string `yaml:"notifySlack"`
+	NotifyEmail   string `yaml:"notifyEmail"`
+	DryRun        bool   `yaml:"dryRun"`
+}
+
+// siteConfig configures one UniFi site: how to reach its controller and the
+// per-switch policies that apply to it.
+type siteConfig struct {
+	Name     string         `yaml:"name"`
+	Host     string         `yaml:"host"`
+	Port     string         `yaml:"port"`
+	User     string         `yaml:"user"`
+	Pass     string         `yaml:"pass"`
+	Version  int            `yaml:"version"`
+	Switches []switchPolicy `yaml:"switches"`
+}
+
+// config is the top-level -config file structure, covering a whole
+// multi-site UniFi estate with heterogeneous, per-switch policies.
+type config struct {
+	Sites []siteConfig `yaml:"sites"`
+}
+
+// loadConfig reads and parses the YAML file at path.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	// Fall back to the same defaults as the single-site flags for fields a
+	// minimal per-site stanza would naturally omit.
+	for i := range cfg.Sites {
+		if cfg.Sites[i].Port == "" {
+			cfg.Sites[i].Port = "8443"
+		}
+		if cfg.Sites[i].Version == 0 {
+			cfg.Sites[i].Version = 5
+		}
+	}
+	return &cfg, nil
+}
+
+// policyFor returns the switch policy that applies to swName: an exact name
+// match wins, falling back to a "*" catch-all policy if present. There is no
+// per-port-name scoping; every port on a matched switch shares one policy.
+func policyFor(site siteConfig, swName string) (switchPolicy, bool) {
+	var wildcard switchPolicy
+	haveWildcard := false
+	for _, p := range site.Switches {
+		if p.Name == swName {
+			return p, true
+		}
+		if p.Name == "*" {
+			wildcard = p
+			haveWildcard = true
+		}
+	}
+	return wildcard, haveWildcard
+}
+
+// runConfig applies every site/policy in cfg in turn and writes one combined
+// Nagios check result for the whole estate. Unlike the single-site
+// flag-driven flow, it adds no perfdata and applies no execution-time
+// thresholds.
+func runConfig(cfg *config) {
+	timestampStart := time.Now()
+	c := counters{}
+
+	check := checker.New()
+	writer := activeWriter.New()
+
+	var auditLog *auditLogger
+	if *auditLogPath != "" {
+		var err error
+		auditLog, err = newAuditLogger(*auditLogPath)
+		if err != nil {
+			log.Fatalf("config: could not open audit log: %s", err)
+		}
+		defer auditLog.close()
+	}
+
+	var state *stateStore
+	if *stateFile != "" {
+		var err error
+		state, err = loadStateStore(*stateFile)
+		if err != nil {
+			log.Fatalf("config: could not load state file: %s", err)
+		}
+	}
+
+	for _, site := range cfg.Sites {
+		runConfigSite(site, auditLog, state, &c)
+	}
+
+	tExec := time.Now().Sub(timestampStart).Seconds()
+
+	message := fmt.Sprintf("%d active matching alerts, %d ports blocked (%d provisioned-block, %d provisioned-unblock, %d would-block, %d would-unblock, %d failed, %d notify-failed, ExecTime %f)",
+		c.events, c.blocked, c.provisionedBlock, c.provisionedUnblock, c.wouldBlock, c.wouldUnblock, c.failed, c.notifyFailed, tExec)
+	check.Message(message)
+
+	status := status.New()
+	status.Threshold(float64(c.events), nil, r.New(), false)
+	status.Threshold(float64(c.failed), nil, r.New(), false)
+	status.Threshold(float64(c.blocked), r.New(), nil, false)
+	check.Status = status
+
+	writer.Write(check)
+}
+
+// runConfigSite logs in to one site's controller and applies every configured
+// switch policy to the PoE disconnect events seen there.
+func runConfigSite(site siteConfig, auditLog *auditLogger, state *stateStore, c *counters) {
+	u, err := unifi.Login(site.User, site.Pass, site.Host, site.Port, site.Name, site.Version)
+	if err != nil {
+		log.Printf("config: site %s: login error: %s", site.Name, err)
+		return
+	}
+	defer u.Logout()
+
+	s, err := u.Site(site.Name)
+	if err != nil {
+		log.Printf("config: site %s: site error: %s", site.Name, err)
+		return
+	}
+
+	var eventFilter unifi.EventFilter
+	eventFilter.Limit = *eventFilterLimit
+	eventFilter.Start = *eventFilterStart
+	eventFilter.Within = *eventFilterWithin
+
+	rawAlarms, err := u.RawAlarms(s, eventFilter)
+	if err != nil {
+		log.Printf("config: site %s: fetching alarms failed: %s", site.Name, err)
+		return
+	}
+
+	events, err := poeEvents(rawAlarms)
+	if err != nil {
+		log.Printf("config: site %s: parsing events failed: %s", site.Name, err)
+		return
+	}
+
+	// Cache resolved profiles and notifiers per policy, since several
+	// switches may share one, and a notifier's rate-limit state only works
+	// if the same instance is reused across events.
+	profiles := make(map[string]*unifi.PortProfile)
+	resolveProfile := func(name string) (*unifi.PortProfile, error) {
+		if name == "" {
+			return nil, nil
+		}
+		if p, ok := profiles[name]; ok {
+			return p, nil
+		}
+		p, err := u.PortProfile(s, name)
+		if err != nil {
+			return nil, err
+		}
+		profiles[name] = p
+		return p, nil
+	}
+
+	notifiers := make(map[string]*notifier)
+	resolveNotifier := func(policy switchPolicy) *notifier {
+		if policy.NotifyWebhook == "" && policy.NotifySlack == "" && policy.NotifyEmail == "" {
+			return nil
+		}
+		key := policy.NotifyWebhook + "|" + policy.NotifySlack + "|" + policy.NotifyEmail
+		if n, ok := notifiers[key]; ok {
+			return n
+		}
+		n := newNotifier(policy.NotifyWebhook, policy.NotifySlack, policy.NotifyEmail, *notifySMTPServer)
+		notifiers[key] = n
+		return n
+	}
+
+	for _, event := range events {
+		policy, ok := policyFor(site, event.SwName)
+		if !ok {
+			continue
+		}
+
+		// Catch not allowed profile settings, same as the single-site flag path
+		if isReservedProfile(policy.ProfileCurr) {
+			log.Printf("config: site %s: switch %s: not allowed profileCurr %q", site.Name, event.SwName, policy.ProfileCurr)
+			c.failed += 1
+			continue
+		}
+
+		currProfile, err := resolveProfile(policy.ProfileCurr)
+		if err != nil {
+			log.Printf("config: site %s: switch %s: port-profile not found: %s", site.Name, event.SwName, err)
+			c.failed += 1
+			continue
+		}
+		blockProfile, err := resolveProfile(policy.ProfileBlock)
+		if err != nil {
+			log.Printf("config: site %s: switch %s: port-profile not found: %s", site.Name, event.SwName, err)
+			c.failed += 1
+			continue
+		}
+
+		err = do(u, s, site.Name, event, currProfile, blockProfile, policy.ProfileCurr, policy.ProfileBlock, policy.PortNameCurr, policy.PortNameBlock, c, auditLog, policy.DryRun, state, resolveNotifier(policy))
+		if err != nil {
+			c.failed += 1
+			auditLog.log(auditEvent{
+				Timestamp: time.Now(),
+				Site:      site.Name,
+				Switch:    event.SwName,
+				Port:      event.Port,
+				Action:    "fail",
+				EventID:   event.ID,
+				Error:     err.Error(),
+			})
+		}
+	}
+
+	// Force-unblock ports whose state entry outlived -maxBlockDuration, one
+	// policy at a time since each may use a different block profile.
+	maxBlockDuration := time.Duration(*maxBlockDuration) * time.Hour
+	for _, policy := range site.Switches {
+		if isReservedProfile(policy.ProfileCurr) {
+			continue
+		}
+
+		blockProfile, err := resolveProfile(policy.ProfileBlock)
+		if err != nil || blockProfile == nil {
+			continue
+		}
+		currProfile, err := resolveProfile(policy.ProfileCurr)
+		if err != nil {
+			continue
+		}
+
+		var entries []stateEntry
+		for _, e := range state.expired(maxBlockDuration) {
+			if e.Site != site.Name {
+				continue
+			}
+			if p, ok := policyFor(site, e.SwName); ok && p == policy {
+				entries = append(entries, e)
+			}
+		}
+
+		forceUnblockExpired(u, s, site.Name, currProfile, blockProfile, policy.PortNameCurr, state, entries, auditLog, policy.DryRun, c)
+	}
+}
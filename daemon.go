@@ -0,0 +1,148 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/BFLB/unifi"
+)
+
+// runDaemon polls the controller on -pollInterval and keeps the PoE disconnect
+// metrics in memory, exposing them via the HTTP server started by serveMetrics.
+// It never returns; the process is expected to run under a supervisor.
+func runDaemon() {
+	metrics := newMetricsStore()
+	go serveMetrics(*listen, metrics)
+
+	var auditLog *auditLogger
+	if *auditLogPath != "" {
+		var err error
+		auditLog, err = newAuditLogger(*auditLogPath)
+		if err != nil {
+			log.Fatalf("daemon: could not open audit log: %s", err)
+		}
+		defer auditLog.close()
+	}
+
+	var state *stateStore
+	if *stateFile != "" {
+		var err error
+		state, err = loadStateStore(*stateFile)
+		if err != nil {
+			log.Fatalf("daemon: could not load state file: %s", err)
+		}
+	}
+
+	var notify *notifier
+	if *notifyWebhook != "" || *notifySlack != "" || *notifyEmail != "" {
+		notify = newNotifier(*notifyWebhook, *notifySlack, *notifyEmail, *notifySMTPServer)
+	}
+
+	for {
+		poll(metrics, auditLog, state, notify)
+		time.Sleep(time.Duration(*pollInterval) * time.Second)
+	}
+}
+
+// poll performs a single login/fetch/process cycle against the controller and
+// records the result in metrics. Errors are logged and reflected in the
+// liveness state but never stop the daemon.
+func poll(metrics *metricsStore, auditLog *auditLogger, state *stateStore, notify *notifier) {
+	timestampStart := time.Now()
+
+	u, err := unifi.Login(*user, *pass, *host, *port, *site, *version)
+	if err != nil {
+		log.Printf("poll: login error: %s", err)
+		metrics.recordError(err)
+		return
+	}
+	defer u.Logout()
+
+	s, err := u.Site(*site)
+	if err != nil {
+		log.Printf("poll: site error: %s", err)
+		metrics.recordError(err)
+		return
+	}
+
+	currProfile, err := u.PortProfile(s, *profileCurr)
+	if err != nil {
+		log.Printf("poll: port-profile not found: %s", err)
+		metrics.recordError(err)
+		return
+	}
+
+	var blockProfile *unifi.PortProfile
+	if *profileBlock != "" {
+		blockProfile, err = u.PortProfile(s, *profileBlock)
+		if err != nil {
+			log.Printf("poll: port-profile not found: %s", err)
+			metrics.recordError(err)
+			return
+		}
+	}
+
+	var eventFilter unifi.EventFilter
+	eventFilter.Limit = *eventFilterLimit
+	eventFilter.Start = *eventFilterStart
+	eventFilter.Within = *eventFilterWithin
+
+	rawAlarms, err := u.RawAlarms(s, eventFilter)
+	if err != nil {
+		log.Printf("poll: fetching alarms failed: %s", err)
+		metrics.recordError(err)
+		return
+	}
+
+	events, err := poeEvents(rawAlarms)
+	if err != nil {
+		log.Printf("poll: parsing events failed: %s", err)
+		metrics.recordError(err)
+		return
+	}
+
+	c := counters{}
+	for _, event := range events {
+		before := c
+		err := do(u, s, *site, event, currProfile, blockProfile, *profileCurr, *profileBlock, *portNameCurr, *portNameBlock, &c, auditLog, *dryRun, state, notify)
+		if err != nil {
+			c.failed += 1
+			auditLog.log(auditEvent{
+				Timestamp: time.Now(),
+				Site:      *site,
+				Switch:    event.SwName,
+				Port:      event.Port,
+				Action:    "fail",
+				EventID:   event.ID,
+				Error:     err.Error(),
+			})
+		}
+
+		key := portKey{site: *site, sw: event.SwName, port: event.Port}
+		metrics.recordPort(key, delta(before, c))
+	}
+
+	forceUnblockExpired(u, s, *site, currProfile, blockProfile, *portNameCurr, state, state.expired(time.Duration(*maxBlockDuration)*time.Hour), auditLog, *dryRun, &c)
+
+	tExec := time.Now().Sub(timestampStart).Seconds()
+	metrics.recordPoll(c, tExec)
+}
+
+// delta returns the per-field increase of after over before.
+func delta(before counters, after counters) counters {
+	return counters{
+		events:             after.events - before.events,
+		provisionedBlock:   after.provisionedBlock - before.provisionedBlock,
+		provisionedUnblock: after.provisionedUnblock - before.provisionedUnblock,
+		blocked:            after.blocked - before.blocked,
+		unblocked:          after.unblocked - before.unblocked,
+		failed:             after.failed - before.failed,
+		wouldBlock:         after.wouldBlock - before.wouldBlock,
+		wouldUnblock:       after.wouldUnblock - before.wouldUnblock,
+		notifyFailed:       after.notifyFailed - before.notifyFailed,
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -45,6 +46,18 @@ var (
 	eventFilterLimit  = flag.Int("eventFilterLimit", 3000, "Maximum  number of alert events to be fetched")
 	eventFilterStart  = flag.Int("eventFilterStart", 0, "At witch alarm event to start fetching")
 	eventFilterWithin = flag.Int("eventFilterWithin", 24, "How many hours back to be fetched")
+	daemon            = flag.Bool("daemon", false, "Run as a long-running daemon exposing Prometheus metrics instead of a one-shot Nagios check")
+	listen            = flag.String("listen", ":9184", "Address to listen on in daemon mode")
+	pollInterval      = flag.Int("pollInterval", 60, "Seconds between controller polls in daemon mode")
+	auditLogPath      = flag.String("auditLog", "", "If set, append a JSON line per block/unblock/fail action to this file")
+	dryRun            = flag.Bool("dryRun", false, "Do not change any port-overrides, only print the per-port diff of what would change")
+	stateFile         = flag.String("stateFile", "", "If set, persist blocked ports (site/switch/port/event/time) to this JSON file across runs")
+	maxBlockDuration  = flag.Int("maxBlockDuration", 0, "If set (hours), force-unblock ports whose -stateFile entry is older than this, even without an archived event")
+	notifyWebhook     = flag.String("notifyWebhook", "", "If set, POST a JSON notification to this URL on block/unblock")
+	notifySlack       = flag.String("notifySlack", "", "If set, POST a Slack-formatted notification to this incoming-webhook URL on block/unblock")
+	notifyEmail       = flag.String("notifyEmail", "", "If set, email this address on block/unblock")
+	notifySMTPServer  = flag.String("notifySMTPServer", "localhost:25", "SMTP server used for -notifyEmail")
+	configPath        = flag.String("config", "", "Path to a YAML config covering multiple sites/switches with per-switch policies. Overrides the single-site flags below")
 	v                 = flag.Bool("V", false, "Version")
 )
 
@@ -56,6 +69,9 @@ type counters struct {
 	blocked            int
 	unblocked          int
 	failed             int
+	wouldBlock         int
+	wouldUnblock       int
+	notifyFailed       int
 }
 
 func main() {
@@ -86,6 +102,17 @@ func main() {
 		writer.Write(check)
 	}
 
+	// Config-file mode: protect a whole multi-site estate per its policies,
+	// bypassing the single-site flags below entirely
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("could not load config: %s", err)
+		}
+		runConfig(cfg)
+		return
+	}
+
 	// Check mandatory args
 	if *host == "" {
 		flag.Usage()
@@ -100,11 +127,16 @@ func main() {
 		flag.Usage()
 	}
 	// Catch not allowed profile settings
-	switch strings.ToLower(*profileCurr) {
-	case "", "all", "disabled":
+	if isReservedProfile(*profileCurr) {
 		flag.Usage()
 	}
 
+	// Daemon mode: serve Prometheus metrics instead of running a single Nagios check
+	if *daemon {
+		runDaemon()
+		return
+	}
+
 	// Set ranges (monitoring) TODO: Move down
 	var rangeExecWarn *r.Range
 	var rangeExecCrit *r.Range
@@ -129,11 +161,43 @@ func main() {
 	defer u.Logout()
 
 	// Get site
+	siteName := *site
 	site, err := u.Site(*site)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Open audit log, if configured
+	var auditLog *auditLogger
+	if *auditLogPath != "" {
+		auditLog, err = newAuditLogger(*auditLogPath)
+		if err != nil {
+			message = fmt.Sprintf("Could not open audit log:%s", err.Error())
+			check.Status.Unknown()
+			check.Message(message)
+			writer.Write(check)
+		}
+		defer auditLog.close()
+	}
+
+	// Set up notifications, if configured
+	var notify *notifier
+	if *notifyWebhook != "" || *notifySlack != "" || *notifyEmail != "" {
+		notify = newNotifier(*notifyWebhook, *notifySlack, *notifyEmail, *notifySMTPServer)
+	}
+
+	// Load persistent block state, if configured
+	var state *stateStore
+	if *stateFile != "" {
+		state, err = loadStateStore(*stateFile)
+		if err != nil {
+			message = fmt.Sprintf("Could not load state file:%s", err.Error())
+			check.Status.Unknown()
+			check.Message(message)
+			writer.Write(check)
+		}
+	}
+
 	// Get current port-profile
 	currProfile, err := u.PortProfile(site, *profileCurr)
 	if err != nil {
@@ -175,12 +239,24 @@ func main() {
 	events, err := poeEvents(rawAlarms)
 
 	for _, event := range events {
-		do(u, site, event, currProfile, blockProfile, *portNameCurr, *portNameBlock, &counters)
+		err := do(u, site, siteName, event, currProfile, blockProfile, *profileCurr, *profileBlock, *portNameCurr, *portNameBlock, &counters, auditLog, *dryRun, state, notify)
 		if err != nil {
 			counters.failed += 1
+			auditLog.log(auditEvent{
+				Timestamp: time.Now(),
+				Site:      siteName,
+				Switch:    event.SwName,
+				Port:      event.Port,
+				Action:    "fail",
+				EventID:   event.ID,
+				Error:     err.Error(),
+			})
 		}
 	}
 
+	// Force-unblock ports whose state entry outlived -maxBlockDuration
+	forceUnblockExpired(u, site, siteName, currProfile, blockProfile, *portNameCurr, state, state.expired(time.Duration(*maxBlockDuration)*time.Hour), auditLog, *dryRun, &counters)
+
 	tExec := time.Now().Sub(timestampStart).Seconds()
 	// HACK: Better way to do it?
 	// Round to 3 digits
@@ -188,7 +264,11 @@ func main() {
 	tExec, _ = strconv.ParseFloat(tExecRounded, 64)
 
 	// Add message
-	message = fmt.Sprintf("%d active matching alerts, %d ports blocked (%d provisioned-block, %d provisioned-unblock, %d failed, EcecTime %f)", counters.events, counters.blocked, counters.provisionedBlock, counters.provisionedUnblock, counters.failed, tExec)
+	if *dryRun {
+		message = fmt.Sprintf("%d active matching alerts, %d ports blocked (%d would-block, %d would-unblock, %d failed, %d notify-failed, EcecTime %f) [dry-run]", counters.events, counters.blocked, counters.wouldBlock, counters.wouldUnblock, counters.failed, counters.notifyFailed, tExec)
+	} else {
+		message = fmt.Sprintf("%d active matching alerts, %d ports blocked (%d provisioned-block, %d provisioned-unblock, %d failed, %d notify-failed, EcecTime %f)", counters.events, counters.blocked, counters.provisionedBlock, counters.provisionedUnblock, counters.failed, counters.notifyFailed, tExec)
+	}
 	check.Message(message)
 
 	// Set ranges for Executiontime warning and critical
@@ -214,6 +294,9 @@ func main() {
 		dataObj, _ = p.New("Failed", float64(counters.failed), "", nil, r.New(), nil, nil)
 		check.Perfdata(dataObj)
 
+		dataObj, _ = p.New("NotifyFailed", float64(counters.notifyFailed), "", nil, r.New(), nil, nil)
+		check.Perfdata(dataObj)
+
 		dataObj, _ = p.New("ExecTime", tExec, "s", rangeWarn, rangeCrit, nil, nil)
 		check.Perfdata(dataObj)
 
@@ -246,7 +329,7 @@ func main() {
 
 // Gets the switch and port and checks if the configured profile belongs to the check.
 // Adds coniguration changes to the port depending of command arguments
-func do(u *unifi.Unifi, site *unifi.Site, event unifi.EVT_SW_PoeDisconnect, currProfile *unifi.PortProfile, blockProfile *unifi.PortProfile, currPortName string, blockPortName string, c *counters) error {
+func do(u *unifi.Unifi, site *unifi.Site, siteName string, event unifi.EVT_SW_PoeDisconnect, currProfile *unifi.PortProfile, blockProfile *unifi.PortProfile, currProfileName string, blockProfileName string, currPortName string, blockPortName string, c *counters, audit *auditLogger, dry bool, state *stateStore, notify *notifier) error {
 
 	// Get the switch
 	usw, err := u.USW(site, event.SwName)
@@ -268,12 +351,46 @@ func do(u *unifi.Unifi, site *unifi.Site, event unifi.EVT_SW_PoeDisconnect, curr
 					// Check if must be blocked
 					if blockProfile != nil {
 						// Change settings (block)
-						overrides[i].PortconfID = blockProfile.ID
+						prevProfileID := overrides[i].PortconfID
+						prevName := overrides[i].Name
+						newName := prevName
 						if blockPortName != "" {
-							overrides[i].Name = blockPortName
+							newName = blockPortName
+						}
+						if dry {
+							printDiff(usw.DeviceID, event.Port, prevProfileID, blockProfile.ID, prevName, newName)
+							c.wouldBlock += 1
+						} else {
+							overrides[i].PortconfID = blockProfile.ID
+							if blockPortName != "" {
+								overrides[i].Name = blockPortName
+							}
+							u.SetPortoverrides(site, usw.DeviceID, overrides)
+							c.provisionedBlock += 1
+							audit.log(auditEvent{
+								Timestamp:     time.Now(),
+								Site:          siteName,
+								Switch:        usw.DeviceID,
+								Port:          event.Port,
+								Action:        "block",
+								PrevProfileID: prevProfileID,
+								NewProfileID:  blockProfile.ID,
+								EventID:       event.ID,
+							})
+							if state != nil {
+								state.recordBlock(siteName, usw.DeviceID, event.SwName, event.Port, event.ID)
+							}
+							c.notifyFailed += notify.notify(notifyPayload{
+								Site:         siteName,
+								Switch:       usw.DeviceID,
+								SwitchName:   event.SwName,
+								Port:         event.Port,
+								Action:       "block",
+								Time:         time.Now(),
+								CurrProfile:  currProfileName,
+								BlockProfile: blockProfileName,
+							})
 						}
-						u.SetPortoverrides(site, usw.DeviceID, overrides)
-						c.provisionedBlock += 1
 					}
 				} else { // Check if port already blocked
 					if overrides[i].PortconfID == blockProfile.ID {
@@ -287,12 +404,46 @@ func do(u *unifi.Unifi, site *unifi.Site, event unifi.EVT_SW_PoeDisconnect, curr
 					if overrides[i].PortconfID == blockProfile.ID {
 						c.blocked += 1
 						// Change settings (unblock)
-						overrides[i].PortconfID = currProfile.ID
+						prevProfileID := overrides[i].PortconfID
+						prevName := overrides[i].Name
+						newName := prevName
 						if currPortName != "" {
-							overrides[i].Name = currPortName
+							newName = currPortName
+						}
+						if dry {
+							printDiff(usw.DeviceID, event.Port, prevProfileID, currProfile.ID, prevName, newName)
+							c.wouldUnblock += 1
+						} else {
+							overrides[i].PortconfID = currProfile.ID
+							if currPortName != "" {
+								overrides[i].Name = currPortName
+							}
+							u.SetPortoverrides(site, usw.DeviceID, overrides)
+							c.provisionedUnblock += 1
+							audit.log(auditEvent{
+								Timestamp:     time.Now(),
+								Site:          siteName,
+								Switch:        usw.DeviceID,
+								Port:          event.Port,
+								Action:        "unblock",
+								PrevProfileID: prevProfileID,
+								NewProfileID:  currProfile.ID,
+								EventID:       event.ID,
+							})
+							if state != nil {
+								state.remove(siteName, usw.DeviceID, event.Port)
+							}
+							c.notifyFailed += notify.notify(notifyPayload{
+								Site:         siteName,
+								Switch:       usw.DeviceID,
+								SwitchName:   event.SwName,
+								Port:         event.Port,
+								Action:       "unblock",
+								Time:         time.Now(),
+								CurrProfile:  currProfileName,
+								BlockProfile: blockProfileName,
+							})
 						}
-						u.SetPortoverrides(site, usw.DeviceID, overrides)
-						c.provisionedUnblock += 1
 					}
 				}
 			}
@@ -302,6 +453,85 @@ func do(u *unifi.Unifi, site *unifi.Site, event unifi.EVT_SW_PoeDisconnect, curr
 	return nil
 }
 
+// forceUnblockExpired unblocks ports that -stateFile still lists as blocked by
+// this tool but that have been blocked for longer than maxBlockDuration, even
+// though no (still in-window) archived event calls for it.
+func forceUnblockExpired(u *unifi.Unifi, site *unifi.Site, siteName string, currProfile *unifi.PortProfile, blockProfile *unifi.PortProfile, currPortName string, state *stateStore, entries []stateEntry, audit *auditLogger, dry bool, c *counters) {
+	if state == nil || blockProfile == nil || len(entries) == 0 {
+		return
+	}
+
+	for _, e := range entries {
+		usw, err := u.USW(site, e.SwName)
+		if err != nil {
+			continue
+		}
+
+		overrides := usw.PortOverrides
+		for i := range overrides {
+			if overrides[i].PortIdx != e.Port {
+				continue
+			}
+			if overrides[i].PortconfID != blockProfile.ID {
+				// Already unblocked some other way; just drop the stale entry.
+				state.remove(e.Site, e.Switch, e.Port)
+				break
+			}
+
+			prevProfileID := overrides[i].PortconfID
+			prevName := overrides[i].Name
+			newName := prevName
+			if currPortName != "" {
+				newName = currPortName
+			}
+
+			if dry {
+				printDiff(usw.DeviceID, e.Port, prevProfileID, currProfile.ID, prevName, newName)
+				c.wouldUnblock += 1
+				break
+			}
+
+			overrides[i].PortconfID = currProfile.ID
+			if currPortName != "" {
+				overrides[i].Name = currPortName
+			}
+			u.SetPortoverrides(site, usw.DeviceID, overrides)
+			c.provisionedUnblock += 1
+			audit.log(auditEvent{
+				Timestamp:     time.Now(),
+				Site:          siteName,
+				Switch:        usw.DeviceID,
+				Port:          e.Port,
+				Action:        "force-unblock",
+				PrevProfileID: prevProfileID,
+				NewProfileID:  currProfile.ID,
+				EventID:       e.EventID,
+			})
+			state.remove(e.Site, e.Switch, e.Port)
+			break
+		}
+	}
+}
+
+// printDiff reports a single would-be port-override change in -dryRun mode.
+// It is written to -path if set, otherwise printed to stdout.
+func printDiff(deviceID string, port int, prevProfileID string, newProfileID string, prevName string, newName string) {
+	line := fmt.Sprintf("[dry-run] switch=%s port=%d profile: %s -> %s, name: %q -> %q\n", deviceID, port, prevProfileID, newProfileID, prevName, newName)
+
+	if *path == "" {
+		fmt.Print(line)
+		return
+	}
+
+	f, err := os.OpenFile(*path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Print(line)
+		return
+	}
+	defer f.Close()
+	f.WriteString(line)
+}
+
 // Returns a slice with poeEvents. One per switch/port combination. Non-Archived wins.
 func poeEvents(rawEvents []unifi.RawAlarm) ([]unifi.EVT_SW_PoeDisconnect, error) {
 	var poeEvents []unifi.EVT_SW_PoeDisconnect
@@ -352,3 +582,15 @@ func archived(event unifi.EVT_SW_PoeDisconnect) bool {
 	}
 	return *event.Archived
 }
+
+// isReservedProfile reports whether name is a profileCurr value this check
+// refuses to run against, because it would protect none or all ports on a
+// switch instead of a specific, deliberately-scoped profile. Shared between
+// the single-site flag path and config-mode policy validation.
+func isReservedProfile(name string) bool {
+	switch strings.ToLower(name) {
+	case "", "all", "disabled":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// portKey identifies a single site/switch/port combination for per-port metrics.
+type portKey struct {
+	site string
+	sw   string
+	port int
+}
+
+// metricsStore keeps the in-memory PoE disconnect metrics exposed in daemon
+// mode. It is safe for concurrent use by the poll loop and the HTTP handlers.
+type metricsStore struct {
+	mu sync.Mutex
+
+	totals   counters
+	execTime float64
+
+	perPort map[portKey]*counters
+
+	lastPollTime  time.Time
+	lastPollError error
+}
+
+func newMetricsStore() *metricsStore {
+	return &metricsStore{
+		perPort: make(map[portKey]*counters),
+	}
+}
+
+// recordPoll adds the counters of a finished poll cycle to the running totals.
+func (m *metricsStore) recordPoll(c counters, execTime float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totals.events += c.events
+	m.totals.provisionedBlock += c.provisionedBlock
+	m.totals.provisionedUnblock += c.provisionedUnblock
+	m.totals.blocked += c.blocked
+	m.totals.unblocked += c.unblocked
+	m.totals.failed += c.failed
+	m.totals.wouldBlock += c.wouldBlock
+	m.totals.wouldUnblock += c.wouldUnblock
+	m.totals.notifyFailed += c.notifyFailed
+	m.execTime = execTime
+	m.lastPollTime = time.Now()
+	m.lastPollError = nil
+}
+
+// recordPort adds the per-event counter delta to the per-port breakdown.
+func (m *metricsStore) recordPort(key portKey, c counters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.perPort[key]
+	if !ok {
+		entry = &counters{}
+		m.perPort[key] = entry
+	}
+	entry.events += c.events
+	entry.provisionedBlock += c.provisionedBlock
+	entry.provisionedUnblock += c.provisionedUnblock
+	entry.blocked += c.blocked
+	entry.unblocked += c.unblocked
+	entry.failed += c.failed
+}
+
+// recordError records a poll cycle that failed before any events could be
+// processed, e.g. a login or controller fetch error.
+func (m *metricsStore) recordError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastPollTime = time.Now()
+	m.lastPollError = err
+}
+
+// render writes the current metrics in Prometheus text exposition format.
+func (m *metricsStore) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := ""
+	s += "# HELP poe_disconnect_active_matching_alerts Active matching PoE disconnect alerts\n"
+	s += "# TYPE poe_disconnect_active_matching_alerts counter\n"
+	s += fmt.Sprintf("poe_disconnect_active_matching_alerts %d\n", m.totals.events)
+
+	s += "# HELP poe_disconnect_ports_blocked_total Ports found blocked\n"
+	s += "# TYPE poe_disconnect_ports_blocked_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_ports_blocked_total %d\n", m.totals.blocked)
+
+	s += "# HELP poe_disconnect_provisioned_block_total Ports provisioned to the block profile\n"
+	s += "# TYPE poe_disconnect_provisioned_block_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_provisioned_block_total %d\n", m.totals.provisionedBlock)
+
+	s += "# HELP poe_disconnect_provisioned_unblock_total Ports provisioned back to the current profile\n"
+	s += "# TYPE poe_disconnect_provisioned_unblock_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_provisioned_unblock_total %d\n", m.totals.provisionedUnblock)
+
+	s += "# HELP poe_disconnect_failed_total Ports that failed to process\n"
+	s += "# TYPE poe_disconnect_failed_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_failed_total %d\n", m.totals.failed)
+
+	s += "# HELP poe_disconnect_would_block_total Ports that would have been blocked under -dryRun\n"
+	s += "# TYPE poe_disconnect_would_block_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_would_block_total %d\n", m.totals.wouldBlock)
+
+	s += "# HELP poe_disconnect_would_unblock_total Ports that would have been unblocked under -dryRun\n"
+	s += "# TYPE poe_disconnect_would_unblock_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_would_unblock_total %d\n", m.totals.wouldUnblock)
+
+	s += "# HELP poe_disconnect_notify_failed_total Notifications that failed to send\n"
+	s += "# TYPE poe_disconnect_notify_failed_total counter\n"
+	s += fmt.Sprintf("poe_disconnect_notify_failed_total %d\n", m.totals.notifyFailed)
+
+	s += "# HELP poe_disconnect_exec_time_seconds Duration of the last poll cycle\n"
+	s += "# TYPE poe_disconnect_exec_time_seconds gauge\n"
+	s += fmt.Sprintf("poe_disconnect_exec_time_seconds %f\n", m.execTime)
+
+	s += "# HELP poe_disconnect_port_events_total Matching PoE disconnect alerts by site/switch/port\n"
+	s += "# TYPE poe_disconnect_port_events_total counter\n"
+	for key, c := range m.perPort {
+		s += fmt.Sprintf("poe_disconnect_port_events_total{site=%q,switch=%q,port=\"%d\"} %d\n", key.site, key.sw, key.port, c.events)
+	}
+
+	s += "# HELP poe_disconnect_port_blocked_total Times found blocked by site/switch/port\n"
+	s += "# TYPE poe_disconnect_port_blocked_total counter\n"
+	for key, c := range m.perPort {
+		s += fmt.Sprintf("poe_disconnect_port_blocked_total{site=%q,switch=%q,port=\"%d\"} %d\n", key.site, key.sw, key.port, c.blocked)
+	}
+
+	s += "# HELP poe_disconnect_port_provisioned_block_total Ports provisioned to the block profile by site/switch/port\n"
+	s += "# TYPE poe_disconnect_port_provisioned_block_total counter\n"
+	for key, c := range m.perPort {
+		s += fmt.Sprintf("poe_disconnect_port_provisioned_block_total{site=%q,switch=%q,port=\"%d\"} %d\n", key.site, key.sw, key.port, c.provisionedBlock)
+	}
+
+	s += "# HELP poe_disconnect_port_provisioned_unblock_total Ports provisioned back to the current profile by site/switch/port\n"
+	s += "# TYPE poe_disconnect_port_provisioned_unblock_total counter\n"
+	for key, c := range m.perPort {
+		s += fmt.Sprintf("poe_disconnect_port_provisioned_unblock_total{site=%q,switch=%q,port=\"%d\"} %d\n", key.site, key.sw, key.port, c.provisionedUnblock)
+	}
+
+	s += "# HELP poe_disconnect_port_failed_total Ports that failed to process by site/switch/port\n"
+	s += "# TYPE poe_disconnect_port_failed_total counter\n"
+	for key, c := range m.perPort {
+		s += fmt.Sprintf("poe_disconnect_port_failed_total{site=%q,switch=%q,port=\"%d\"} %d\n", key.site, key.sw, key.port, c.failed)
+	}
+
+	return s
+}
+
+// healthy reports whether the last poll cycle succeeded.
+func (m *metricsStore) healthy() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lastPollError == nil, m.lastPollError
+}
+
+// serveMetrics starts the HTTP server exposing /metrics and /healthz. It
+// blocks and is expected to be run in its own goroutine.
+func serveMetrics(listen string, metrics *metricsStore) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, metrics.render())
+	})
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ok, err := metrics.healthy()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "unhealthy: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	log.Printf("daemon: listening on %s", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.Fatalf("daemon: %s", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// notifyPayload is the event handed to every configured notification target.
+type notifyPayload struct {
+	Site         string    `json:"site"`
+	Switch       string    `json:"switch"` // UniFi DeviceID, for machine consumers (e.g. the webhook target)
+	SwitchName   string    `json:"switchName"`
+	Port         int       `json:"port"`
+	Action       string    `json:"action"` // "block" or "unblock"
+	Time         time.Time `json:"time"`
+	CurrProfile  string    `json:"currProfile"`
+	BlockProfile string    `json:"blockProfile"`
+}
+
+// notifyRateLimit is the minimum interval between notifications for the same
+// (switch, port), to avoid flapping storms.
+const notifyRateLimit = 5 * time.Minute
+
+// notifier fans a block/unblock event out to the configured, best-effort
+// notification targets. A failed notification never fails the check; it is
+// only counted.
+type notifier struct {
+	webhook    string
+	slack      string
+	email      string
+	smtpServer string
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// newNotifier builds a notifier for the given targets. Targets left empty are
+// simply skipped.
+func newNotifier(webhook string, slack string, email string, smtpServer string) *notifier {
+	return &notifier{
+		webhook:    webhook,
+		slack:      slack,
+		email:      email,
+		smtpServer: smtpServer,
+		lastSent:   make(map[string]time.Time),
+	}
+}
+
+// notify sends payload to every configured target, unless (switch, port) was
+// already notified within notifyRateLimit. Returns the number of targets that
+// failed to send.
+func (n *notifier) notify(payload notifyPayload) int {
+	if n == nil {
+		return 0
+	}
+
+	key := fmt.Sprintf("%s|%s|%d", payload.Site, payload.Switch, payload.Port)
+
+	n.mu.Lock()
+	last, seen := n.lastSent[key]
+	if seen && time.Since(last) < notifyRateLimit {
+		n.mu.Unlock()
+		return 0
+	}
+	n.lastSent[key] = time.Now()
+	n.mu.Unlock()
+
+	failed := 0
+
+	if n.webhook != "" {
+		if err := n.sendWebhook(payload); err != nil {
+			failed += 1
+		}
+	}
+	if n.slack != "" {
+		if err := n.sendSlack(payload); err != nil {
+			failed += 1
+		}
+	}
+	if n.email != "" {
+		if err := n.sendEmail(payload); err != nil {
+			failed += 1
+		}
+	}
+
+	return failed
+}
+
+func (n *notifier) sendWebhook(payload notifyPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(n.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) sendSlack(payload notifyPayload) error {
+	text := fmt.Sprintf("PoE %s: site=%s switch=%s port=%d currProfile=%s blockProfile=%s at %s",
+		payload.Action, payload.Site, payload.SwitchName, payload.Port, payload.CurrProfile, payload.BlockProfile, payload.Time.Format(time.RFC3339))
+
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(n.slack, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) sendEmail(payload notifyPayload) error {
+	subject := fmt.Sprintf("PoE %s on %s port %d", payload.Action, payload.SwitchName, payload.Port)
+	body := fmt.Sprintf("Site: %s\nSwitch: %s\nPort: %d\nAction: %s\nTime: %s\nCurrent profile: %s\nBlock profile: %s\n",
+		payload.Site, payload.SwitchName, payload.Port, payload.Action, payload.Time.Format(time.RFC3339), payload.CurrProfile, payload.BlockProfile)
+
+	msg := fmt.Sprintf("Subject: %s\r\n\r\n%s", subject, body)
+	return smtp.SendMail(n.smtpServer, nil, "check_unifi_poe_disconnect", []string{n.email}, []byte(msg))
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateEntry records that this tool blocked a given site/switch/port, and
+// under which event, so the decision to unblock it later does not depend
+// solely on the event still being inside -eventFilterWithin hours.
+type stateEntry struct {
+	Site      string    `json:"site"`
+	Switch    string    `json:"switch"` // DeviceID
+	SwName    string    `json:"swName"` // switch name, as used by u.USW
+	Port      int       `json:"port"`
+	EventID   string    `json:"eventId"`
+	BlockedAt time.Time `json:"blockedAt"`
+}
+
+// stateStore is a JSON-file-backed map of blocked ports, keyed by
+// site/switch/port. It is saved after every change.
+type stateStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]stateEntry
+}
+
+func stateKey(site string, sw string, port int) string {
+	return fmt.Sprintf("%s|%s|%d", site, sw, port)
+}
+
+// loadStateStore reads the state file at path, if it exists, and returns a
+// stateStore ready for use. A missing file is not an error; it is treated as
+// an empty store.
+func loadStateStore(path string) (*stateStore, error) {
+	s := &stateStore{path: path, entries: make(map[string]stateEntry)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []stateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		s.entries[stateKey(e.Site, e.Switch, e.Port)] = e
+	}
+	return s, nil
+}
+
+// save writes the current state to disk as a JSON array.
+func (s *stateStore) save() error {
+	entries := make([]stateEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// recordBlock marks site/switch/port as blocked by this tool and persists it.
+func (s *stateStore) recordBlock(site string, sw string, swName string, port int, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[stateKey(site, sw, port)] = stateEntry{
+		Site:      site,
+		Switch:    sw,
+		SwName:    swName,
+		Port:      port,
+		EventID:   eventID,
+		BlockedAt: time.Now(),
+	}
+	return s.save()
+}
+
+// remove clears a blocked-port entry and persists it.
+func (s *stateStore) remove(site string, sw string, port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, stateKey(site, sw, port))
+	return s.save()
+}
+
+// get returns the state entry for site/switch/port, if any.
+func (s *stateStore) get(site string, sw string, port int) (stateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[stateKey(site, sw, port)]
+	return e, ok
+}
+
+// expired returns the blocked entries older than maxBlockDuration. It returns
+// nil if state is nil or maxBlockDuration is not set.
+func (s *stateStore) expired(maxBlockDuration time.Duration) []stateEntry {
+	if s == nil || maxBlockDuration <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []stateEntry
+	for _, e := range s.entries {
+		if time.Since(e.BlockedAt) >= maxBlockDuration {
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
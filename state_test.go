@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Bernhard Fluehmann. All rights reserved.
+// Use of this source code is governed by ISC-style license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateKey(t *testing.T) {
+	cases := []struct {
+		site string
+		sw   string
+		port int
+		want string
+	}{
+		{"default", "dev-1", 1, "default|dev-1|1"},
+		{"site-a", "dev-1", 1, "site-a|dev-1|1"},
+		{"default", "dev-2", 1, "default|dev-2|1"},
+		{"default", "dev-1", 2, "default|dev-1|2"},
+	}
+
+	for _, c := range cases {
+		got := stateKey(c.site, c.sw, c.port)
+		if got != c.want {
+			t.Errorf("stateKey(%q, %q, %d) = %q, want %q", c.site, c.sw, c.port, got, c.want)
+		}
+	}
+
+	// Different site/switch/port triples must never collide.
+	seen := make(map[string]bool)
+	for _, c := range cases {
+		k := stateKey(c.site, c.sw, c.port)
+		if seen[k] && k != c.want {
+			t.Errorf("stateKey collision for %q", k)
+		}
+		seen[k] = true
+	}
+}
+
+func TestStateStoreExpired(t *testing.T) {
+	maxBlockDuration := time.Hour
+
+	makeEntry := func(site string, sw string, port int, age time.Duration) stateEntry {
+		return stateEntry{
+			Site:      site,
+			Switch:    sw,
+			Port:      port,
+			BlockedAt: time.Now().Add(-age),
+		}
+	}
+
+	s := &stateStore{entries: make(map[string]stateEntry)}
+	s.entries[stateKey("default", "dev-1", 1)] = makeEntry("default", "dev-1", 1, maxBlockDuration+time.Minute) // past the boundary
+	s.entries[stateKey("default", "dev-1", 2)] = makeEntry("default", "dev-1", 2, maxBlockDuration-time.Minute) // short of the boundary
+	s.entries[stateKey("default", "dev-1", 3)] = makeEntry("default", "dev-1", 3, maxBlockDuration)             // exactly at the boundary
+
+	expired := s.expired(maxBlockDuration)
+	if len(expired) != 2 {
+		t.Fatalf("expired() returned %d entries, want 2 (ports 1 and 3): %+v", len(expired), expired)
+	}
+	for _, e := range expired {
+		if e.Port == 2 {
+			t.Errorf("expired() included port 2, which is short of maxBlockDuration")
+		}
+	}
+}
+
+func TestStateStoreExpiredNilOrUnset(t *testing.T) {
+	if got := (*stateStore)(nil).expired(time.Hour); got != nil {
+		t.Errorf("expired() on nil store = %+v, want nil", got)
+	}
+
+	s := &stateStore{entries: make(map[string]stateEntry)}
+	s.entries[stateKey("default", "dev-1", 1)] = stateEntry{BlockedAt: time.Now().Add(-24 * time.Hour)}
+	if got := s.expired(0); got != nil {
+		t.Errorf("expired(0) = %+v, want nil (force-unblock disabled)", got)
+	}
+}